@@ -8,10 +8,13 @@ See package fs for the filesystem implementation.
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	stdlog "log"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -23,6 +26,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/zach-klippenstein/adbfs/fs"
 	"github.com/zach-klippenstein/goadb"
+	_ "golang.org/x/net/trace"
 )
 
 var (
@@ -31,6 +35,14 @@ var (
 	adbPort      = flag.Int("port", goadb.AdbPort, "Port to connect to adb server on.")
 	logLevel     = flag.String("loglevel", "info", "Detail of logs to show.")
 	cacheTtl     = flag.Duration("cachettl", 300*time.Millisecond, "Duration to keep cached file info.")
+
+	writeback            = flag.Bool("writeback", false, "Buffer writes to a local staging file and upload them to the device in the background, instead of blocking Release on the upload.")
+	writebackDir         = flag.String("writeback-dir", filepath.Join(os.TempDir(), "adbfs-writeback"), "Staging directory for -writeback.")
+	writebackMaxBytes    = flag.Int64("writeback-maxbytes", 256<<20, "Maximum total size of already-uploaded files kept in the -writeback staging directory before they are evicted. Files still waiting to upload are not counted.")
+	writebackMaxInFlight = flag.Int("writeback-maxinflight", 4, "Maximum number of concurrent -writeback uploads.")
+	writebackMaxAttempts = flag.Int("writeback-maxattempts", fs.DefaultRetryPolicy.MaxAttempts, "Maximum upload attempts per -writeback file before giving up.")
+
+	diagAddr = flag.String("diag-addr", "", "If set, serve /debug/requests, /debug/events, /debug/pprof, and /metrics on this address (e.g. localhost:6060).")
 )
 
 var (
@@ -58,6 +70,10 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *diagAddr != "" {
+		startDiagServer(*diagAddr)
+	}
+
 	cache := initializeCache(*cacheTtl)
 
 	clientConfig := goadb.ClientConfig{
@@ -71,31 +87,35 @@ func main() {
 		log.Fatal(err)
 	}
 
-	serverDone, err := startServer(StartTimeout)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	serverDone, err := startServer(ctx, StartTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("mounted %s on %s", *deviceSerial, absoluteMountpoint)
 	defer unmountServer()
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, os.Kill)
-
-	for {
-		select {
-		case signal := <-signals:
-			log.Println("got signal", signal)
-			switch signal {
-			case os.Kill, os.Interrupt:
-				log.Println("exiting...")
-				return
-			}
-
-		case <-serverDone:
-			log.Debugln("server done channel closed.")
-			return
+	<-serverDone
+	log.Debugln("server done channel closed.")
+}
+
+// startDiagServer serves /debug/requests and /debug/events (registered on
+// http.DefaultServeMux by the golang.org/x/net/trace import above),
+// /debug/pprof/* (registered by the net/http/pprof import above), and
+// /metrics, all on addr. It returns immediately and serves in the
+// background; failures are logged, not fatal, since diagnostics shouldn't
+// take down a working mount.
+func startDiagServer(addr string) {
+	http.Handle("/metrics", fs.DefaultMetrics)
+
+	go func() {
+		log.Infoln("diagnostics listening on", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Errorln("diagnostics server failed:", err)
 		}
-	}
+	}()
 }
 
 func initializeLogger() {
@@ -127,14 +147,30 @@ func initializeCache(ttl time.Duration) fs.DirEntryCache {
 }
 
 func initializeFileSystem(clientConfig goadb.ClientConfig, mountpoint string, cache fs.DirEntryCache, deviceNotFoundHandler func()) *pathfs.PathNodeFs {
-	clientFactory := fs.NewCachingDeviceClientFactory(cache,
-		fs.NewGoadbDeviceClientFactory(clientConfig, *deviceSerial))
+	goadbFactory := fs.NewGoadbDeviceClientFactory(clientConfig, *deviceSerial)
+
+	var clientFactory fs.DeviceClientFactory
+	if *writeback {
+		log.Infoln("writeback enabled, staging dir:", *writebackDir)
+		clientFactory = fs.NewWritebackCachingDeviceClientFactory(cache, goadbFactory, fs.WritebackConfig{
+			StagingDir:         *writebackDir,
+			MaxStagingBytes:    *writebackMaxBytes,
+			MaxInFlightUploads: *writebackMaxInFlight,
+			RetryPolicy: fs.RetryPolicy{
+				MaxAttempts: *writebackMaxAttempts,
+				BaseBackoff: fs.DefaultRetryPolicy.BaseBackoff,
+				MaxBackoff:  fs.DefaultRetryPolicy.MaxBackoff,
+			},
+		}, log)
+	} else {
+		clientFactory = fs.NewCachingDeviceClientFactory(cache, goadbFactory)
+	}
 
 	var fsImpl pathfs.FileSystem
 	fsImpl, err := fs.NewAdbFileSystem(fs.Config{
-		Mountpoint:    mountpoint,
-		ClientFactory: clientFactory,
-		Log:           log,
+		Mountpoint:            mountpoint,
+		ClientFactory:         clientFactory,
+		Log:                   log,
 		DeviceNotFoundHandler: deviceNotFoundHandler,
 	})
 	if err != nil {
@@ -144,13 +180,14 @@ func initializeFileSystem(clientConfig goadb.ClientConfig, mountpoint string, ca
 	return pathfs.NewPathNodeFs(fsImpl, nil)
 }
 
-func startServer(startTimeout time.Duration) (<-chan struct{}, error) {
+func startServer(ctx context.Context, startTimeout time.Duration) (<-chan struct{}, error) {
 	serverDone := make(chan struct{})
 	go func() {
 		defer close(serverDone)
-		server.Serve()
+		if err := Serve(ctx); err != nil {
+			log.Errorln(err)
+		}
 		log.Println("server finished.")
-		return
 	}()
 
 	// Wait for OS to finish initializing the mount.
@@ -173,6 +210,28 @@ func startServer(startTimeout time.Duration) (<-chan struct{}, error) {
 	}
 }
 
+// Serve runs the mounted FUSE server until it stops on its own or ctx is
+// cancelled, mirroring the Serve(ctx context.Context) error shape used
+// elsewhere in the Go ecosystem. Cancelling ctx (e.g. on SIGINT) unmounts
+// the filesystem so in-flight operations against a hung device are
+// interrupted rather than blocking forever.
+func Serve(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Serve()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		unmountServer()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func unmountServer() {
 	if server == nil {
 		panic("attempted to unmount server before creating it")
@@ -1,18 +1,25 @@
 package adbfs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/zach-klippenstein/goadb"
 )
 
 type CachingDeviceClient struct {
 	DeviceClient
 	Cache DirEntryCache
+
+	// Writeback is nil unless write-back mode (-writeback) is enabled, in
+	// which case OpenWrite buffers to it instead of writing straight
+	// through to the device.
+	Writeback *Writeback
 }
 
 type CachedDirEntries struct {
@@ -29,6 +36,30 @@ func NewCachingDeviceClientFactory(cache DirEntryCache, factory DeviceClientFact
 	}
 }
 
+// NewWritebackCachingDeviceClientFactory is like NewCachingDeviceClientFactory,
+// but additionally enables write-back mode per the -writeback flag: OpenWrite
+// returns as soon as the write lands in writebackCfg.StagingDir, and the
+// upload to the device happens in the background.
+func NewWritebackCachingDeviceClientFactory(cache DirEntryCache, factory DeviceClientFactory, writebackCfg WritebackConfig, log *logrus.Logger) DeviceClientFactory {
+	return func() DeviceClient {
+		client := &CachingDeviceClient{
+			DeviceClient: factory(),
+			Cache:        cache,
+		}
+
+		writeback, err := NewWriteback(writebackCfg, client.DeviceClient, log, func(name string) {
+			client.Cache.RemoveEventually(path.Dir(name))
+		})
+		if err != nil {
+			log.WithError(err).Error("failed to enable writeback, falling back to write-through")
+			return client
+		}
+
+		client.Writeback = writeback
+		return client
+	}
+}
+
 func NewCachedDirEntries(entries []*adb.DirEntry) *CachedDirEntries {
 	result := &CachedDirEntries{
 		InOrder: entries,
@@ -42,13 +73,19 @@ func NewCachedDirEntries(entries []*adb.DirEntry) *CachedDirEntries {
 	return result
 }
 
-func (c *CachingDeviceClient) Stat(name string, log *LogEntry) (*adb.DirEntry, error) {
+func (c *CachingDeviceClient) Stat(ctx context.Context, name string, log *LogEntry) (*adb.DirEntry, error) {
+	if c.Writeback != nil {
+		if entry, found := c.Writeback.Overlay(name); found {
+			return entry, nil
+		}
+	}
+
 	dir := path.Dir(name)
 	base := path.Base(name)
 
 	if dir == base {
 		// Don't ask the cache for the root stat, we never cache the root.
-		return c.DeviceClient.Stat(name, log)
+		return c.DeviceClient.Stat(ctx, name, log)
 	}
 
 	if entries, found := c.Cache.Get(dir); found {
@@ -65,12 +102,12 @@ func (c *CachingDeviceClient) Stat(name string, log *LogEntry) (*adb.DirEntry, e
 	log.CacheUsed(false)
 
 	// The directory doesn't exist in the cache, so perform a one-off lookup on the device.
-	return c.DeviceClient.Stat(name, log)
+	return c.DeviceClient.Stat(ctx, name, log)
 }
 
-func (c *CachingDeviceClient) ListDirEntries(path string, log *LogEntry) ([]*adb.DirEntry, error) {
+func (c *CachingDeviceClient) ListDirEntries(ctx context.Context, path string, log *LogEntry) ([]*adb.DirEntry, error) {
 	entries, err, hit := c.Cache.GetOrLoad(path, func(path string) (*CachedDirEntries, error) {
-		entries, err := c.DeviceClient.ListDirEntries(path, log)
+		entries, err := c.DeviceClient.ListDirEntries(ctx, path, log)
 		if err != nil {
 			return nil, err
 		}
@@ -81,12 +118,40 @@ func (c *CachingDeviceClient) ListDirEntries(path string, log *LogEntry) ([]*adb
 	if err != nil {
 		return nil, err
 	}
-	return entries.InOrder, nil
+	if c.Writeback == nil {
+		return entries.InOrder, nil
+	}
+	return c.overlayDirtyEntries(path, entries.InOrder), nil
+}
+
+// overlayDirtyEntries replaces the entry of any file in entries that has a
+// pending write-back upload, so a listing taken right after writing a file
+// reflects what's about to be uploaded rather than what's still on the
+// device. Files with a pending upload that are not already in entries
+// (e.g. newly created ones) are not added.
+func (c *CachingDeviceClient) overlayDirtyEntries(dir string, entries []*adb.DirEntry) []*adb.DirEntry {
+	overlaid := false
+	result := make([]*adb.DirEntry, len(entries))
+	for i, entry := range entries {
+		if dirty, found := c.Writeback.Overlay(path.Join(dir, entry.Name)); found {
+			entry = dirty
+			overlaid = true
+		}
+		result[i] = entry
+	}
+	if !overlaid {
+		return entries
+	}
+	return result
 }
 
-func (c *CachingDeviceClient) OpenWrite(name string, perms os.FileMode, mtime time.Time, log *LogEntry) (io.WriteCloser, error) {
+func (c *CachingDeviceClient) OpenWrite(ctx context.Context, name string, perms os.FileMode, mtime time.Time, log *LogEntry) (io.WriteCloser, error) {
+	if c.Writeback != nil {
+		return c.Writeback.OpenWrite(ctx, name, perms, mtime, log)
+	}
+
 	// Writing to the file obviously invalidates the file's cache entry.
-	w, err := c.DeviceClient.OpenWrite(name, perms, mtime, log)
+	w, err := c.DeviceClient.OpenWrite(ctx, name, perms, mtime, log)
 
 	// The mtime is only set on the file on close, so don't bother invalidating the cache until then.
 	onClosed := func() {
@@ -95,6 +160,17 @@ func (c *CachingDeviceClient) OpenWrite(name string, perms os.FileMode, mtime ti
 	return onCloseWriter{w, onClosed}, err
 }
 
+// Fsync blocks until name's pending write-back upload, if any, has
+// reached the device.
+func (c *CachingDeviceClient) Fsync(ctx context.Context, name string, log *LogEntry) error {
+	if c.Writeback != nil {
+		if err := c.Writeback.Fsync(ctx, name); err != nil {
+			return err
+		}
+	}
+	return c.DeviceClient.Fsync(ctx, name, log)
+}
+
 type onCloseWriter struct {
 	io.WriteCloser
 	onClosed func()
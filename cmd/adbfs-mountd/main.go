@@ -0,0 +1,297 @@
+/*
+adbfs-mountd is a daemon that mounts every device visible to your adb server,
+and keeps mounting/unmounting devices as they come and go.
+
+Unlike adbfs, it doesn't take a -device or -mountpoint: it watches the adb
+server's device stream and manages one mount per connected serial under
+-root, tearing the mount down again when the device disconnects.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	stdlog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/zach-klippenstein/adbfs/fs"
+	"github.com/zach-klippenstein/goadb"
+)
+
+var (
+	mountRoot      = flag.String("root", "/mnt/adbfs", "Directory under which to mount each connected device, one subdirectory per serial.")
+	adbPort        = flag.Int("port", goadb.AdbPort, "Port to connect to adb server on.")
+	logLevel       = flag.String("loglevel", "info", "Detail of logs to show.")
+	cacheTtl       = flag.Duration("cachettl", 300*time.Millisecond, "Duration to keep cached file info.")
+	statusAddr     = flag.String("statusaddr", "", "If set, serve a JSON list of currently mounted devices on this address (e.g. localhost:8673).")
+	unmountTimeout = flag.Duration("unmounttimeout", 5*time.Second, "How long to wait for all devices to unmount on shutdown before giving up.")
+)
+
+var log *logrus.Logger
+
+// mountedDevice tracks one device's live FUSE mount.
+type mountedDevice struct {
+	serial     string
+	mountpoint string
+	server     *fuse.Server
+	cancel     context.CancelFunc
+	mountedAt  time.Time
+
+	// unmountOnce guards server.Unmount(), which both the mount's own
+	// watcher goroutine (on deviceCtx cancellation) and daemon.unmount/
+	// shutdown (on a device event or daemon shutdown) can call.
+	unmountOnce sync.Once
+}
+
+// doUnmount calls md.server.Unmount(), but only the first time it's
+// called for md.
+func (md *mountedDevice) doUnmount() {
+	md.unmountOnce.Do(md.server.Unmount)
+}
+
+// daemon owns the serial -> mountedDevice map. Each mount gets its own
+// DirEntryCache: the cache is keyed purely by on-device path, and two
+// different devices can easily share a path (e.g. /sdcard/DCIM), so a
+// cache shared across devices would leak one device's stats to another.
+type daemon struct {
+	mu           sync.Mutex
+	mounts       map[string]*mountedDevice
+	clientConfig goadb.ClientConfig
+}
+
+func main() {
+	flag.Parse()
+	initializeLogger()
+
+	d := &daemon{
+		mounts:       make(map[string]*mountedDevice),
+		clientConfig: goadb.ClientConfig{Dialer: goadb.NewDialer("", *adbPort)},
+	}
+
+	if *statusAddr != "" {
+		go d.serveStatus(*statusAddr)
+	}
+
+	server, err := goadb.NewWithConfig(d.clientConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	watcher := server.NewDeviceWatcher()
+	defer watcher.Shutdown()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	log.Infof("watching for devices, mounting under %s", *mountRoot)
+
+	for {
+		select {
+		case event, ok := <-watcher.C():
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					log.Errorln("device watcher stopped:", err)
+				}
+				d.shutdown()
+				return
+			}
+			d.handleDeviceEvent(ctx, event)
+
+		case <-ctx.Done():
+			log.Infoln("got signal, unmounting all devices...")
+			d.shutdown()
+			return
+		}
+	}
+}
+
+func (d *daemon) handleDeviceEvent(ctx context.Context, event goadb.DeviceStateChangedEvent) {
+	if event.NewState == goadb.StateOnline {
+		d.mount(ctx, event.Serial)
+	} else {
+		d.unmount(event.Serial)
+	}
+}
+
+// mount brings up a FUSE mount for serial, with its own DirEntryCache.
+// It's idempotent: a serial that's already mounted is left alone.
+func (d *daemon) mount(ctx context.Context, serial string) {
+	d.mu.Lock()
+	_, exists := d.mounts[serial]
+	d.mu.Unlock()
+	if exists {
+		return
+	}
+
+	mountpoint := filepath.Join(*mountRoot, serial)
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		log.Errorln("failed to create mountpoint for", serial, err)
+		return
+	}
+
+	deviceCtx, cancel := context.WithCancel(ctx)
+
+	clientFactory := fs.NewCachingDeviceClientFactory(fs.NewDirEntryCache(*cacheTtl),
+		fs.NewGoadbDeviceClientFactory(d.clientConfig, serial))
+
+	fsImpl, err := fs.NewAdbFileSystem(fs.Config{
+		Mountpoint:            mountpoint,
+		ClientFactory:         clientFactory,
+		Log:                   log,
+		DeviceNotFoundHandler: func() { d.unmount(serial) },
+	})
+	if err != nil {
+		log.Errorln("failed to initialize filesystem for", serial, err)
+		cancel()
+		return
+	}
+
+	nodeFs := pathfs.NewPathNodeFs(fsImpl, nil)
+	server, _, err := nodefs.MountRoot(mountpoint, nodeFs.Root(), nil)
+	if err != nil {
+		log.Errorln("failed to mount", serial, "at", mountpoint, err)
+		cancel()
+		return
+	}
+
+	md := &mountedDevice{
+		serial:     serial,
+		mountpoint: mountpoint,
+		server:     server,
+		cancel:     cancel,
+		mountedAt:  time.Now(),
+	}
+
+	d.mu.Lock()
+	d.mounts[serial] = md
+	d.mu.Unlock()
+
+	log.Infof("mounted %s on %s", serial, mountpoint)
+
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.Serve()
+		}()
+
+		select {
+		case <-done:
+		case <-deviceCtx.Done():
+			md.doUnmount()
+			<-done
+		}
+		d.unmount(serial)
+	}()
+}
+
+// unmount tears down serial's mount, if any. Safe to call more than once,
+// or for a serial that was never mounted.
+func (d *daemon) unmount(serial string) {
+	d.mu.Lock()
+	md, exists := d.mounts[serial]
+	if exists {
+		delete(d.mounts, serial)
+	}
+	d.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	log.Infof("unmounting %s from %s", serial, md.mountpoint)
+	md.cancel()
+	md.doUnmount()
+}
+
+// shutdown unmounts every currently-mounted device in parallel, giving up
+// after -unmounttimeout so a single hung device can't block the others.
+func (d *daemon) shutdown() {
+	d.mu.Lock()
+	mounts := make([]*mountedDevice, 0, len(d.mounts))
+	for _, md := range d.mounts {
+		mounts = append(mounts, md)
+	}
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, md := range mounts {
+		wg.Add(1)
+		go func(md *mountedDevice) {
+			defer wg.Done()
+			md.cancel()
+			md.doUnmount()
+		}(md)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(*unmountTimeout):
+		log.Warnln("timed out waiting for all devices to unmount")
+	}
+}
+
+type mountStatus struct {
+	Serial     string    `json:"serial"`
+	Mountpoint string    `json:"mountpoint"`
+	MountedAt  time.Time `json:"mounted_at"`
+}
+
+// serveStatus serves a JSON list of currently mounted devices on addr,
+// until the process exits.
+func (d *daemon) serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		statuses := make([]mountStatus, 0, len(d.mounts))
+		for _, md := range d.mounts {
+			statuses = append(statuses, mountStatus{md.serial, md.mountpoint, md.mountedAt})
+		}
+		d.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+
+	log.Infoln("status endpoint listening on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorln("status endpoint failed:", err)
+	}
+}
+
+func initializeLogger() {
+	log = logrus.StandardLogger()
+
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Level = level
+
+	log.Formatter = &logrus.TextFormatter{
+		FullTimestamp: true,
+		// RFC 3339 with milliseconds.
+		TimestampFormat: "2006-01-02T15:04:05.000000000Z07:00",
+	}
+
+	// Redirect standard logger (used by fuse) to our logger.
+	stdlog.SetOutput(log.Writer())
+	// Disable standard log timestamps, logrus has its own.
+	stdlog.SetFlags(0)
+}
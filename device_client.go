@@ -1,8 +1,10 @@
 package adbfs
 
 import (
+	"context"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/zach-klippenstein/goadb"
@@ -10,12 +12,16 @@ import (
 
 // DeviceClient wraps adb.Device for testing.
 type DeviceClient interface {
-	OpenRead(path string, log *LogEntry) (io.ReadCloser, error)
-	OpenWrite(path string, perms os.FileMode, mtime time.Time, log *LogEntry) (io.WriteCloser, error)
-	Stat(path string, log *LogEntry) (*adb.DirEntry, error)
-	ListDirEntries(path string, log *LogEntry) ([]*adb.DirEntry, error)
+	OpenRead(ctx context.Context, path string, log *LogEntry) (io.ReadCloser, error)
+	OpenWrite(ctx context.Context, path string, perms os.FileMode, mtime time.Time, log *LogEntry) (io.WriteCloser, error)
+	Stat(ctx context.Context, path string, log *LogEntry) (*adb.DirEntry, error)
+	ListDirEntries(ctx context.Context, path string, log *LogEntry) ([]*adb.DirEntry, error)
 
-	RunCommand(cmd string, args ...string) (string, error)
+	RunCommand(ctx context.Context, cmd string, args ...string) (string, error)
+
+	// Fsync blocks until any writes to path that this client knows about
+	// (e.g. a pending write-back upload) have reached the device.
+	Fsync(ctx context.Context, path string, log *LogEntry) error
 }
 
 // goadbDeviceClient is an implementation of DeviceClient that wraps
@@ -45,27 +51,49 @@ func NewGoadbDeviceClientFactory(server *adb.Adb, deviceSerial string, deviceDis
 	}
 }
 
-func (c goadbDeviceClient) OpenRead(path string, _ *LogEntry) (io.ReadCloser, error) {
+func (c goadbDeviceClient) OpenRead(ctx context.Context, path string, _ *LogEntry) (io.ReadCloser, error) {
 	r, err := c.Device.OpenRead(path)
 	if adb.HasErrCode(err, adb.DeviceNotFound) {
 		return nil, c.handleDeviceNotFound(err)
 	}
-	return r, err
+	if err != nil {
+		return nil, err
+	}
+	return contextReadCloser{r, watchContext(ctx, r)}, nil
 }
 
-func (c goadbDeviceClient) OpenWrite(path string, mode os.FileMode, mtime time.Time, _ *LogEntry) (io.WriteCloser, error) {
-	return c.Device.OpenWrite(path, mode, mtime)
+func (c goadbDeviceClient) OpenWrite(ctx context.Context, path string, mode os.FileMode, mtime time.Time, _ *LogEntry) (io.WriteCloser, error) {
+	w, err := c.Device.OpenWrite(path, mode, mtime)
+	if err != nil {
+		return nil, err
+	}
+	return contextWriteCloser{w, watchContext(ctx, w)}, nil
 }
 
-func (c goadbDeviceClient) Stat(path string, _ *LogEntry) (*adb.DirEntry, error) {
-	e, err := c.Device.Stat(path)
-	if adb.HasErrCode(err, adb.DeviceNotFound) {
-		return nil, c.handleDeviceNotFound(err)
+func (c goadbDeviceClient) Stat(ctx context.Context, path string, _ *LogEntry) (*adb.DirEntry, error) {
+	type statResult struct {
+		entry *adb.DirEntry
+		err   error
+	}
+
+	done := make(chan statResult, 1)
+	go func() {
+		entry, err := c.Device.Stat(path)
+		done <- statResult{entry, err}
+	}()
+
+	select {
+	case result := <-done:
+		if adb.HasErrCode(result.err, adb.DeviceNotFound) {
+			return nil, c.handleDeviceNotFound(result.err)
+		}
+		return result.entry, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return e, err
 }
 
-func (c goadbDeviceClient) ListDirEntries(path string, _ *LogEntry) ([]*adb.DirEntry, error) {
+func (c goadbDeviceClient) ListDirEntries(ctx context.Context, path string, _ *LogEntry) ([]*adb.DirEntry, error) {
 	entries, err := c.Device.ListDirEntries(path)
 	if err != nil {
 		if adb.HasErrCode(err, adb.DeviceNotFound) {
@@ -73,12 +101,85 @@ func (c goadbDeviceClient) ListDirEntries(path string, _ *LogEntry) ([]*adb.DirE
 		}
 		return nil, err
 	}
+
+	// entries is a SyncScanner reading off the device's socket: if ctx is
+	// cancelled before ReadAll finishes, close it out from under the read so
+	// a hung device can't block the mount forever.
+	stop := watchContext(ctx, entries)
+	defer stop()
 	return entries.ReadAll()
 }
 
+func (c goadbDeviceClient) RunCommand(ctx context.Context, cmd string, args ...string) (string, error) {
+	type cmdResult struct {
+		output string
+		err    error
+	}
+
+	done := make(chan cmdResult, 1)
+	go func() {
+		output, err := c.Device.RunCommand(cmd, args...)
+		done <- cmdResult{output, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.output, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Fsync is a no-op: every goadbDeviceClient write already completes
+// synchronously against the device, so there's nothing pending to flush.
+func (c goadbDeviceClient) Fsync(ctx context.Context, path string, _ *LogEntry) error {
+	return nil
+}
+
 func (c goadbDeviceClient) handleDeviceNotFound(err error) error {
 	if c.deviceDisconnectedHandler != nil {
 		c.deviceDisconnectedHandler()
 	}
 	return err
 }
+
+// watchContext closes target as soon as ctx is done, so a device operation
+// that's hung on the wire gets interrupted instead of blocking its caller
+// forever. The returned stop func must be called once the caller is done
+// with target (whether or not ctx was ever cancelled), so the watcher
+// goroutine can exit.
+func watchContext(ctx context.Context, target io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			target.Close()
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stopped) })
+	}
+}
+
+type contextReadCloser struct {
+	io.ReadCloser
+	stop func()
+}
+
+func (c contextReadCloser) Close() error {
+	defer c.stop()
+	return c.ReadCloser.Close()
+}
+
+type contextWriteCloser struct {
+	io.WriteCloser
+	stop func()
+}
+
+func (c contextWriteCloser) Close() error {
+	defer c.stop()
+	return c.WriteCloser.Close()
+}
@@ -20,7 +20,7 @@ If an error is reported, it is logged as a separate entry.
 Example Usage
 
 	func DoTheThing(path string) fuse.Status {
-		logEntry := StartOperation("DoTheThing", path)
+		logEntry := StartOperation(CategoryFuse, "DoTheThing", path)
 		defer FinishOperation(log) // Where log is a logrus logger.
 
 		result, err := perform(path)
@@ -37,6 +37,7 @@ type LogEntry struct {
 	name      string
 	path      string
 	args      string
+	category  Category
 	startTime time.Time
 	err       error
 	result    string
@@ -50,22 +51,27 @@ type LogEntry struct {
 
 var traceEntryFormatter = new(logrus.JSONFormatter)
 
-// StartOperation creates a new LogEntry with the current time.
+// StartOperation creates a new LogEntry with the current time, tagged with
+// category for ADBFS_TRACE filtering.
 // Should be immediately followed by a deferred call to FinishOperation.
-func StartOperation(name string, path string) *LogEntry {
+func StartOperation(category Category, name string, path string) *LogEntry {
+	DefaultMetrics.recordStart(name)
 	return &LogEntry{
 		name:      name,
 		path:      path,
+		category:  category,
 		startTime: time.Now(),
 		trace:     trace.New(name, path),
 	}
 }
 
-func StartFileOperation(name string, args string) *LogEntry {
+func StartFileOperation(category Category, name string, args string) *LogEntry {
 	name = "File " + name
+	DefaultMetrics.recordStart(name)
 	return &LogEntry{
 		name:      name,
 		args:      args,
+		category:  category,
 		startTime: time.Now(),
 		trace:     trace.New(name, args),
 	}
@@ -117,6 +123,8 @@ func (r *LogEntry) CacheUsed(hit bool) {
 // FinishOperation should be deferred. It will log the duration of the operation, as well
 // as any results and/or errors.
 func (r *LogEntry) FinishOperation(log *logrus.Logger) {
+	DefaultMetrics.recordFinish(r, time.Since(r.startTime))
+
 	entry := log.WithFields(logrus.Fields{
 		"duration_ms": calculateDurationMillis(r.startTime),
 		"status":      r.status,
@@ -136,7 +144,13 @@ func (r *LogEntry) FinishOperation(log *logrus.Logger) {
 		entry = entry.WithField("cache_hit", r.cacheHit)
 	}
 
-	entry.Debug(r.name)
+	// Only pay for the debug field dump if this operation's category was
+	// requested via ADBFS_TRACE. It's logged at info level so it shows
+	// without raising the whole logger to debug. Errors are still logged
+	// below, and the trace viewer always gets the fields.
+	if categoryEnabled(r.category) {
+		entry.Info(r.name)
+	}
 
 	if r.err != nil {
 		log.Errorln(util.ErrorWithCauseChain(r.err))
@@ -165,4 +179,4 @@ func (r *LogEntry) logTrace(entry *logrus.Entry) {
 
 func calculateDurationMillis(startTime time.Time) int64 {
 	return time.Now().Sub(startTime).Nanoseconds() / time.Millisecond.Nanoseconds()
-}
\ No newline at end of file
+}
@@ -0,0 +1,187 @@
+package adbfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the
+// adbfs_operation_latency_seconds histogram, covering a roughly
+// log-scaled range from a fast in-process op up to a slow adb round trip.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// opMetrics accumulates counters and latency for one operation name.
+type opMetrics struct {
+	mu sync.Mutex
+
+	total       int64
+	errors      map[string]int64 // adb error code (or "other") -> count
+	cacheHits   int64
+	cacheMisses int64
+	inFlight    int64
+	latencySum  time.Duration
+	// latencyBucketCounts[i] counts operations whose latency was <=
+	// latencyBuckets[i], mirroring Prometheus's cumulative histogram
+	// convention.
+	latencyBucketCounts []int64
+}
+
+// MetricsRegistry tracks per-operation counters (total, errors, cache
+// hits/misses, in-flight, latency), fed by StartOperation/StartFileOperation
+// (in-flight) and LogEntry.FinishOperation (everything else). It
+// implements http.Handler so it can be mounted directly, e.g. at /metrics.
+type MetricsRegistry struct {
+	mu  sync.Mutex
+	ops map[string]*opMetrics
+}
+
+// DefaultMetrics is the registry every LogEntry reports to.
+var DefaultMetrics = NewMetricsRegistry()
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{ops: make(map[string]*opMetrics)}
+}
+
+func (m *MetricsRegistry) forOp(name string) *opMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, found := m.ops[name]
+	if !found {
+		op = &opMetrics{
+			errors:              make(map[string]int64),
+			latencyBucketCounts: make([]int64, len(latencyBuckets)),
+		}
+		m.ops[name] = op
+	}
+	return op
+}
+
+func (m *MetricsRegistry) recordStart(name string) {
+	op := m.forOp(name)
+	op.mu.Lock()
+	op.inFlight++
+	op.mu.Unlock()
+}
+
+func (m *MetricsRegistry) recordFinish(r *LogEntry, duration time.Duration) {
+	op := m.forOp(r.name)
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.inFlight--
+	op.total++
+	op.latencySum += duration
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			op.latencyBucketCounts[i]++
+		}
+	}
+
+	if r.cacheUsed {
+		if r.cacheHit {
+			op.cacheHits++
+		} else {
+			op.cacheMisses++
+		}
+	}
+	if r.err != nil {
+		op.errors[adbErrCode(r.err)]++
+	}
+}
+
+// adbErrCode classifies err by the adb.ErrCode it carries, via
+// adb.HasErrCode, falling back to "other" for errors that don't carry one
+// of the codes we know to check for.
+func adbErrCode(err error) string {
+	for _, code := range []adb.ErrCode{adb.DeviceNotFound} {
+		if adb.HasErrCode(err, code) {
+			return fmt.Sprint(code)
+		}
+	}
+	return "other"
+}
+
+// ServeHTTP writes all metrics in Prometheus text exposition format.
+func (m *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func (m *MetricsRegistry) WriteTo(w io.Writer) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.ops))
+	for name := range m.ops {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP adbfs_operation_total Total completed operations.")
+	fmt.Fprintln(w, "# TYPE adbfs_operation_total counter")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		fmt.Fprintf(w, "adbfs_operation_total{op=%q} %d\n", name, op.total)
+		op.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP adbfs_operation_errors_total Completed operations that returned an error, by adb error code.")
+	fmt.Fprintln(w, "# TYPE adbfs_operation_errors_total counter")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		for code, count := range op.errors {
+			fmt.Fprintf(w, "adbfs_operation_errors_total{op=%q,code=%q} %d\n", name, code, count)
+		}
+		op.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP adbfs_operation_in_flight Operations currently executing.")
+	fmt.Fprintln(w, "# TYPE adbfs_operation_in_flight gauge")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		fmt.Fprintf(w, "adbfs_operation_in_flight{op=%q} %d\n", name, op.inFlight)
+		op.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP adbfs_cache_hits_total Cache lookups that were satisfied from the cache.")
+	fmt.Fprintln(w, "# TYPE adbfs_cache_hits_total counter")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		fmt.Fprintf(w, "adbfs_cache_hits_total{op=%q} %d\n", name, op.cacheHits)
+		op.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP adbfs_cache_misses_total Cache lookups that fell through to the device.")
+	fmt.Fprintln(w, "# TYPE adbfs_cache_misses_total counter")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		fmt.Fprintf(w, "adbfs_cache_misses_total{op=%q} %d\n", name, op.cacheMisses)
+		op.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP adbfs_operation_latency_seconds Operation latency distribution, in seconds.")
+	fmt.Fprintln(w, "# TYPE adbfs_operation_latency_seconds histogram")
+	for _, name := range names {
+		op := m.forOp(name)
+		op.mu.Lock()
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "adbfs_operation_latency_seconds_bucket{op=%q,le=%q} %d\n", name, fmt.Sprint(bound), op.latencyBucketCounts[i])
+		}
+		fmt.Fprintf(w, "adbfs_operation_latency_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", name, op.total)
+		fmt.Fprintf(w, "adbfs_operation_latency_seconds_sum{op=%q} %f\n", name, op.latencySum.Seconds())
+		fmt.Fprintf(w, "adbfs_operation_latency_seconds_count{op=%q} %d\n", name, op.total)
+		op.mu.Unlock()
+	}
+}
@@ -0,0 +1,86 @@
+package adbfs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Category identifies a subsystem for fine-grained debug tracing. Categories
+// are enabled independently via the ADBFS_TRACE environment variable, so an
+// operator can turn on e.g. "cache" noise without cranking the whole logger
+// to debug.
+type Category string
+
+const (
+	CategoryCache   Category = "cache"
+	CategoryAdb     Category = "adb"
+	CategoryFuse    Category = "fuse"
+	CategoryStat    Category = "stat"
+	CategoryReaddir Category = "readdir"
+	CategoryWrite   Category = "write"
+
+	// categoryAll enables every category. Not itself a valid Category to
+	// tag an operation with.
+	categoryAll = "all"
+)
+
+var (
+	traceAllCategories bool
+	traceCategories    map[Category]bool
+)
+
+func init() {
+	traceCategories = parseTraceCategories(os.Getenv("ADBFS_TRACE"))
+}
+
+// parseTraceCategories splits the comma-separated ADBFS_TRACE value into the
+// set of enabled categories. "all" enables everything.
+func parseTraceCategories(value string) map[Category]bool {
+	categories := make(map[Category]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		switch part {
+		case "":
+			continue
+		case categoryAll:
+			traceAllCategories = true
+		default:
+			categories[Category(part)] = true
+		}
+	}
+	return categories
+}
+
+// categoryEnabled reports whether category should log its debug output,
+// i.e. it was named in ADBFS_TRACE, or ADBFS_TRACE contained "all".
+func categoryEnabled(category Category) bool {
+	return traceAllCategories || traceCategories[category]
+}
+
+// Tracer is a cheap, category-gated logger for ad-hoc debug statements
+// outside the LogEntry lifecycle, e.g. inside the cache or the goadb
+// wrappers. The enabled check happens once, in Trace, so a disabled
+// category's Printf calls cost a single bool check.
+type Tracer struct {
+	category Category
+	enabled  bool
+}
+
+// Trace returns a Tracer for category, enabled if category (or "all") was
+// listed in ADBFS_TRACE.
+//
+//	adbfs.Trace("cache").Printf("evicting %s", path)
+func Trace(category Category) Tracer {
+	return Tracer{category: category, enabled: categoryEnabled(category)}
+}
+
+// Printf logs a message tagged with this Tracer's category, at info level,
+// if that category is enabled. It's a no-op otherwise.
+func (t Tracer) Printf(format string, args ...interface{}) {
+	if !t.enabled {
+		return
+	}
+	logrus.StandardLogger().WithField("category", t.category).Infof(format, args...)
+}
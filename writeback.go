@@ -0,0 +1,397 @@
+package adbfs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zach-klippenstein/goadb"
+)
+
+// RetryPolicy controls how a failed write-back upload is retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetryPolicy is used by NewWriteback when a WritebackConfig doesn't
+// specify one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseBackoff: 500 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+}
+
+// backoff returns how long to wait after failed upload attempt number
+// attempt (1-based) before making the next one.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseBackoff << uint(attempt-1)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// WritebackConfig configures CachingDeviceClient's opt-in write-back mode,
+// turned on with the -writeback flag.
+type WritebackConfig struct {
+	// StagingDir holds local copies of files that are pending upload, or
+	// have already been uploaded but not yet evicted.
+	StagingDir string
+	// MaxStagingBytes bounds the total size of already-uploaded files kept
+	// in the staging dir. Once exceeded, they are evicted,
+	// least-recently-used first. Files still pending upload are not counted
+	// toward it and are never evicted.
+	MaxStagingBytes int64
+	// MaxInFlightUploads bounds how many uploads run concurrently.
+	MaxInFlightUploads int
+	RetryPolicy        RetryPolicy
+}
+
+// pendingWrite tracks one path that's been written to the staging area,
+// from the moment Release returns until its upload is evicted.
+type pendingWrite struct {
+	stagingPath string
+	perms       os.FileMode
+	mtime       time.Time
+	size        int64
+
+	uploaded   bool
+	uploadDone chan struct{}
+	uploadErr  error
+
+	lastUsed time.Time
+}
+
+// Writeback buffers CachingDeviceClient.OpenWrite calls to a local staging
+// file and uploads them to the device on a background worker, so FUSE's
+// Release can return immediately instead of blocking on a (possibly slow)
+// adb transfer. Stat and ListDirEntries consult it so reads of a
+// just-written file see its pending size and mtime before the upload has
+// actually landed.
+type Writeback struct {
+	cfg    WritebackConfig
+	client DeviceClient
+	log    *logrus.Logger
+
+	// onUploaded is called once a path's upload succeeds, so the caller can
+	// invalidate whatever directory cache covers it.
+	onUploaded func(path string)
+
+	// uploadCtx is the base context background uploads run under. It must
+	// outlive the FUSE op (e.g. Release) that triggers a given upload, so
+	// it's independent of that op's own context rather than derived from it.
+	uploadCtx context.Context
+
+	uploadSlots chan struct{}
+
+	mu          sync.Mutex
+	pending     map[string]*pendingWrite
+	stagedBytes int64
+}
+
+// NewWriteback creates a Writeback that stages files under cfg.StagingDir
+// and uploads them through client. onUploaded is called (from the upload
+// goroutine) after each successful upload.
+func NewWriteback(cfg WritebackConfig, client DeviceClient, log *logrus.Logger, onUploaded func(path string)) (*Writeback, error) {
+	if cfg.MaxInFlightUploads <= 0 {
+		cfg.MaxInFlightUploads = 4
+	}
+	if cfg.RetryPolicy == (RetryPolicy{}) {
+		cfg.RetryPolicy = DefaultRetryPolicy
+	}
+	if err := os.MkdirAll(cfg.StagingDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating writeback staging dir: %w", err)
+	}
+
+	return &Writeback{
+		cfg:         cfg,
+		client:      client,
+		log:         log,
+		onUploaded:  onUploaded,
+		uploadCtx:   context.Background(),
+		uploadSlots: make(chan struct{}, cfg.MaxInFlightUploads),
+		pending:     make(map[string]*pendingWrite),
+	}, nil
+}
+
+// stagingPathFor returns a staging file path for name that won't collide
+// with any other device path.
+func (wb *Writeback) stagingPathFor(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return filepath.Join(wb.cfg.StagingDir, hex.EncodeToString(sum[:]))
+}
+
+// waitForInFlightUpload blocks until any upload already in progress for
+// name has released its staging file, so a new write doesn't truncate the
+// file out from under uploadOnce's concurrent read of it.
+func (wb *Writeback) waitForInFlightUpload(ctx context.Context, name string) error {
+	wb.mu.Lock()
+	pw, found := wb.pending[name]
+	inFlight := found && !pw.uploaded
+	wb.mu.Unlock()
+	if !inFlight {
+		return nil
+	}
+
+	select {
+	case <-pw.uploadDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OpenWrite returns a writer that buffers to the local staging area.
+// Closing it returns as soon as the staged copy is flushed to disk; the
+// upload to the device happens on a background goroutine.
+func (wb *Writeback) OpenWrite(ctx context.Context, name string, perms os.FileMode, mtime time.Time, log *LogEntry) (io.WriteCloser, error) {
+	stagingPath := wb.stagingPathFor(name)
+
+	// name's staging file is reused across writes, so a concurrent upload
+	// of a previous write must have released it before we truncate it.
+	if err := wb.waitForInFlightUpload(ctx, name); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(stagingPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening writeback staging file for '%s': %w", name, err)
+	}
+
+	return &stagingWriter{
+		File: f,
+		onClosed: func(size int64) {
+			wb.stage(name, stagingPath, perms, mtime, size, log)
+		},
+	}, nil
+}
+
+type stagingWriter struct {
+	*os.File
+	size     int64
+	onClosed func(size int64)
+}
+
+func (w *stagingWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *stagingWriter) Close() error {
+	err := w.File.Close()
+	w.onClosed(w.size)
+	return err
+}
+
+// stage records name as dirty and kicks off its background upload.
+func (wb *Writeback) stage(name, stagingPath string, perms os.FileMode, mtime time.Time, size int64, log *LogEntry) {
+	pw := &pendingWrite{
+		stagingPath: stagingPath,
+		perms:       perms,
+		mtime:       mtime,
+		size:        size,
+		uploadDone:  make(chan struct{}),
+		lastUsed:    time.Now(),
+	}
+
+	wb.mu.Lock()
+	// name's previous pending entry, if any, is being replaced: if it had
+	// already finished uploading, its bytes counted toward stagedBytes and
+	// it's about to become unreachable from wb.pending, so account for its
+	// removal now or evictIfNeeded will never see it again.
+	if old, found := wb.pending[name]; found && old.uploaded {
+		wb.stagedBytes -= old.size
+	}
+	wb.pending[name] = pw
+	wb.mu.Unlock()
+
+	go wb.upload(wb.uploadCtx, name, pw)
+}
+
+// upload pushes name's staged file to the device, retrying transient
+// errors with backoff. DeviceNotFound fails fast, since retrying against a
+// disconnected device can't succeed.
+func (wb *Writeback) upload(ctx context.Context, name string, pw *pendingWrite) {
+	wb.uploadSlots <- struct{}{}
+	defer func() { <-wb.uploadSlots }()
+
+	start := time.Now()
+	var attempt int
+	var err error
+
+retry:
+	for attempt = 1; attempt <= wb.cfg.RetryPolicy.MaxAttempts; attempt++ {
+		err = wb.uploadOnce(ctx, name, pw)
+		if err == nil || adb.HasErrCode(err, adb.DeviceNotFound) {
+			break
+		}
+		if attempt == wb.cfg.RetryPolicy.MaxAttempts {
+			break
+		}
+
+		wb.log.WithFields(logrus.Fields{
+			"path":    name,
+			"attempt": attempt,
+			"error":   err,
+		}).Warn("writeback upload failed, retrying")
+
+		select {
+		case <-time.After(wb.cfg.RetryPolicy.backoff(attempt)):
+		case <-ctx.Done():
+			err = ctx.Err()
+			break retry
+		}
+	}
+
+	wb.log.WithFields(logrus.Fields{
+		"path":     name,
+		"bytes":    pw.size,
+		"duration": time.Since(start),
+		"attempts": attempt,
+		"error":    err,
+	}).Info("writeback upload finished")
+
+	// Settle pw's outcome, and forget it on failure, before closing
+	// uploadDone: that's what unblocks a subsequent OpenWrite for name to
+	// reuse its staging file, so the file must already be gone by then.
+	wb.mu.Lock()
+	pw.uploadErr = err
+	pw.lastUsed = time.Now()
+	if err == nil {
+		pw.uploaded = true
+		wb.stagedBytes += pw.size
+	} else {
+		delete(wb.pending, name)
+	}
+	wb.mu.Unlock()
+
+	if err != nil {
+		os.Remove(pw.stagingPath)
+	}
+	close(pw.uploadDone)
+
+	if err == nil {
+		if wb.onUploaded != nil {
+			wb.onUploaded(name)
+		}
+		wb.evictIfNeeded()
+	}
+}
+
+func (wb *Writeback) uploadOnce(ctx context.Context, name string, pw *pendingWrite) error {
+	log := StartFileOperation(CategoryWrite, "WritebackUpload", name)
+	defer log.FinishOperation(wb.log)
+
+	staged, err := os.Open(pw.stagingPath)
+	if err != nil {
+		log.Error(err)
+		return fmt.Errorf("reopening writeback staging file for '%s': %w", name, err)
+	}
+	defer staged.Close()
+
+	w, err := wb.client.OpenWrite(ctx, name, pw.perms, pw.mtime, log)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if _, err := io.Copy(w, staged); err != nil {
+		w.Close()
+		log.Error(err)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Result("uploaded %d bytes", pw.size)
+	return nil
+}
+
+// evictIfNeeded removes already-uploaded staging files, least-recently-used
+// first, until the staging area is back under its byte budget.
+func (wb *Writeback) evictIfNeeded() {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if wb.cfg.MaxStagingBytes <= 0 || wb.stagedBytes <= wb.cfg.MaxStagingBytes {
+		return
+	}
+
+	type candidate struct {
+		name string
+		pw   *pendingWrite
+	}
+	var candidates []candidate
+	for name, pw := range wb.pending {
+		if pw.uploaded {
+			candidates = append(candidates, candidate{name, pw})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].pw.lastUsed.Before(candidates[j].pw.lastUsed)
+	})
+
+	for _, c := range candidates {
+		if wb.stagedBytes <= wb.cfg.MaxStagingBytes {
+			return
+		}
+		os.Remove(c.pw.stagingPath)
+		wb.stagedBytes -= c.pw.size
+		delete(wb.pending, c.name)
+	}
+}
+
+// Pending returns the pending entry for name, if a write-back upload has
+// not yet landed for it.
+func (wb *Writeback) Pending(name string) (*pendingWrite, bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	pw, found := wb.pending[name]
+	if !found || pw.uploaded {
+		return nil, false
+	}
+	return pw, true
+}
+
+// Overlay synthesizes a *adb.DirEntry reflecting name's pending write, if
+// any, so callers see the content that's about to be uploaded instead of
+// what's still on the device.
+func (wb *Writeback) Overlay(name string) (*adb.DirEntry, bool) {
+	pw, found := wb.Pending(name)
+	if !found {
+		return nil, false
+	}
+	return &adb.DirEntry{
+		Name:       filepath.Base(name),
+		Mode:       pw.perms,
+		Size:       int32(pw.size),
+		ModifiedAt: pw.mtime,
+	}, true
+}
+
+// Fsync blocks until name's pending upload (if any) completes.
+func (wb *Writeback) Fsync(ctx context.Context, name string) error {
+	pw, found := wb.Pending(name)
+	if !found {
+		return nil
+	}
+
+	select {
+	case <-pw.uploadDone:
+		return pw.uploadErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}